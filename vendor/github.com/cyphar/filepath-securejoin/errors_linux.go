@@ -0,0 +1,22 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import "errors"
+
+// errPossibleAttack is returned (always wrapped with more specific context)
+// whenever a safety check notices something that should be impossible under
+// any non-adversarial use -- such as a symlink stack that doesn't match the
+// component being popped, a magic-link that no longer points where we
+// expect, or a reopened handle that doesn't match the original (dev, ino).
+var errPossibleAttack = errors.New("possible attack detected")
+
+// maxSymlinkLimit bounds the number of symlinks partialLookupInRoot will
+// follow while resolving a single path before failing with ELOOP, so that a
+// chain of symlinks (or a symlink loop) can't cause us to spin forever. It is
+// more generous than the kernel's own limit of 40 symlinks per lookup.
+const maxSymlinkLimit = 255
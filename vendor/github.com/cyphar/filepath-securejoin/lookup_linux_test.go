@@ -0,0 +1,233 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// swapMode selects what the attacker goroutine in
+// TestPartialLookupInRoot_RaceAttack swaps on each iteration.
+type swapMode int
+
+const (
+	// swapDirSymlink repeatedly renames a directory and a symlink (that
+	// points outside of the root) on top of one another, so the victim
+	// either sees a plain directory or a symlink escaping the root.
+	swapDirSymlink swapMode = iota
+	// swapRootExchange repeatedly exchanges the root directory itself with
+	// another tree via renameat2(RENAME_EXCHANGE).
+	swapRootExchange
+)
+
+// setupRaceAttackTree creates a directory tree rooted at root/target that
+// the attacker goroutine will swap between a directory and a symlink (to
+// outsideDir, which is deliberately outside of root).
+func setupRaceAttackTree(t *testing.T) (root, outsideDir string) {
+	t.Helper()
+
+	base := t.TempDir()
+	root = filepath.Join(base, "root")
+	outsideDir = filepath.Join(base, "outside")
+
+	for _, dir := range []string{root, outsideDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("setup %q: %v", dir, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(outsideDir, "evil"), 0o755); err != nil {
+		t.Fatalf("setup outside/evil: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "target"), 0o755); err != nil {
+		t.Fatalf("setup target: %v", err)
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(root, "target.link")); err != nil {
+		t.Fatalf("setup target.link: %v", err)
+	}
+	return root, outsideDir
+}
+
+// runRaceAttack spawns nAttackers goroutines continuously swapping
+// root/target between a directory and a symlink pointing outside of root
+// (or, in swapRootExchange mode, swapping root itself), while nVictims
+// goroutines repeatedly call partialLookupInRoot("target/foo"). It asserts
+// that every returned handle is either verifiably inside root, or a
+// well-known error.
+func runRaceAttack(t *testing.T, mode swapMode, nAttackers, nVictims, iterations int) {
+	t.Helper()
+
+	root, _ := setupRaceAttackTree(t)
+	target := filepath.Join(root, "target")
+	altRoot := filepath.Join(filepath.Dir(root), "altroot")
+	if mode == swapRootExchange {
+		if err := os.MkdirAll(altRoot, 0o755); err != nil {
+			t.Fatalf("setup altroot: %v", err)
+		}
+	}
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("open root: %v", err)
+	}
+	defer rootDir.Close()
+
+	var (
+		stop     atomic.Bool
+		wg       sync.WaitGroup
+		attacker = func() {
+			defer wg.Done()
+			for !stop.Load() {
+				switch mode {
+				case swapDirSymlink:
+					// Plain rename(2) cannot replace a directory with a
+					// symlink (or vice versa), so exchange the two atomically.
+					_ = unix.Renameat2(unix.AT_FDCWD, target, unix.AT_FDCWD, target+".link", unix.RENAME_EXCHANGE)
+				case swapRootExchange:
+					_ = unix.Renameat2(unix.AT_FDCWD, root, unix.AT_FDCWD, altRoot, unix.RENAME_EXCHANGE)
+				}
+			}
+		}
+	)
+
+	for i := 0; i < nAttackers; i++ {
+		wg.Add(1)
+		go attacker()
+	}
+
+	var victimWg sync.WaitGroup
+	errs := make(chan error, nVictims)
+	for i := 0; i < nVictims; i++ {
+		victimWg.Add(1)
+		go func() {
+			defer victimWg.Done()
+			for n := 0; n < iterations; n++ {
+				handle, remainingPath, err := partialLookupInRoot(rootDir, "target/foo")
+				if err != nil {
+					if isExpectedRaceError(err) {
+						continue
+					}
+					errs <- err
+					return
+				}
+
+				if escErr := assertHandleInRoot(rootDir, handle, remainingPath); escErr != nil {
+					_ = handle.Close()
+					errs <- escErr
+					return
+				}
+				_ = handle.Close()
+			}
+		}()
+	}
+
+	victimWg.Wait()
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("victim observed escape or unexpected error: %v", err)
+	}
+}
+
+// isExpectedRaceError returns true if err is one of the well-typed errors we
+// expect to see when racing against an attacker swapping path components --
+// anything else indicates a bug in the symlink-stack or ".." handling.
+func isExpectedRaceError(err error) bool {
+	return errors.Is(err, errPossibleAttack) ||
+		errors.Is(err, unix.ELOOP) ||
+		errors.Is(err, unix.ENOENT) ||
+		errors.Is(err, os.ErrNotExist)
+}
+
+// assertHandleInRoot verifies that handle (as returned by
+// partialLookupInRoot) is genuinely inside root, by walking up handle's ".."
+// chain and comparing (dev, ino) against rootDir at each step, until either
+// rootDir's inode is found (success) or we reach the filesystem root without
+// finding it (escape). This must be race-free against the attacker goroutine
+// continuously renaming things underneath us: comparing magic-link path
+// strings (as a previous version of this helper did) is not, since reading
+// rootDir's current path and handle's current path are two independent
+// readlinkat(2) calls, and a rename landing between them can make a
+// perfectly valid in-root handle appear to have escaped a now-stale root
+// string. Walking up via fstat/openat(2, "..") instead only ever compares
+// (dev, ino) pairs obtained from fds we hold open ourselves, so there's no
+// window for an in-flight rename to produce a false positive: rootDir keeps
+// pointing at the same inode no matter what name(s) currently refer to it,
+// even under swapRootExchange.
+func assertHandleInRoot(rootDir *os.File, handle *os.File, remainingPath string) error {
+	rootStat, err := fstat(rootDir)
+	if err != nil {
+		return fmt.Errorf("stat root: %w", err)
+	}
+
+	cur, err := dupFile(handle)
+	if err != nil {
+		return fmt.Errorf("dup handle: %w", err)
+	}
+	// cur is reassigned to each successive parent as we walk up, so this
+	// must close whatever cur currently refers to at return time (a
+	// closure over the variable) rather than the dupFile(handle) result
+	// captured at defer-time -- otherwise every "cur = parent" leaks the
+	// previous iteration's handle on every exit path except the explicit
+	// cur.Close() before the next loop iteration.
+	defer func() { _ = cur.Close() }()
+
+	for i := 0; i < maxSymlinkLimit; i++ {
+		curStat, err := fstat(cur)
+		if err != nil {
+			return fmt.Errorf("stat ancestor: %w", err)
+		}
+		if curStat.Dev == rootStat.Dev && curStat.Ino == rootStat.Ino {
+			return nil
+		}
+
+		parent, err := openatFile(cur, "..", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("walk to parent: %w", err)
+		}
+		parentStat, err := fstat(parent)
+		if err != nil {
+			_ = parent.Close()
+			return fmt.Errorf("stat parent: %w", err)
+		}
+		if parentStat.Dev == curStat.Dev && parentStat.Ino == curStat.Ino {
+			// ".." of the current directory is itself -- we've reached the
+			// filesystem root without ever finding rootDir's inode.
+			_ = parent.Close()
+			return fmt.Errorf("handle escaped root: walked up to the filesystem root without finding root's inode (remaining=%q)", remainingPath)
+		}
+
+		cur.Close()
+		cur = parent
+	}
+	return fmt.Errorf("handle escaped root: exceeded symlink limit while walking up parents (remaining=%q)", remainingPath)
+}
+
+func TestPartialLookupInRoot_RaceAttack_DirSymlinkSwap(t *testing.T) {
+	iterations := 50_000
+	if testing.Short() {
+		iterations = 500
+	}
+	runRaceAttack(t, swapDirSymlink, 4, 4, iterations)
+}
+
+func TestPartialLookupInRoot_RaceAttack_RootExchange(t *testing.T) {
+	iterations := 50_000
+	if testing.Short() {
+		iterations = 500
+	}
+	runRaceAttack(t, swapRootExchange, 2, 4, iterations)
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// MkdirAllHandle is equivalent to MkdirAll, except that it is safe against
+// racing attackers (such as symlink-swaps) that would otherwise make
+// SecureJoin+os.MkdirAll unsafe. It returns an *os.File handle to the final
+// created directory, using the O_PATH|O_DIRECTORY flags.
+//
+// Effectively, MkdirAllHandle is to MkdirAll as OpenatInRoot is to
+// SecureJoin+os.Open -- each missing component is created one at a time from
+// a handle to the last resolved component (provided by partialLookupInRoot),
+// so an attacker swapping a path component for a symlink mid-creation can at
+// worst cause mkdirat(2) to fail, never trick us into creating (or
+// re-opening) something outside of root.
+func MkdirAllHandle(root *os.File, unsafePath string, mode os.FileMode) (_ *os.File, Err error) {
+	// Find as much of the path as already exists.
+	currentDir, remainingPath, err := partialLookupInRoot(root, unsafePath)
+	if err != nil {
+		return nil, fmt.Errorf("find existing subpath of %q: %w", unsafePath, err)
+	}
+	defer func() {
+		if Err != nil {
+			_ = currentDir.Close()
+		}
+	}()
+
+	remainingParts := strings.Split(remainingPath, "/")
+	if slices.Contains(remainingParts, "..") {
+		// The path contained ".." components after the end of the "real"
+		// components. We could try to safely resolve ".." here but it's not
+		// clear this is something we need to support, so for now just bail
+		// out rather than risk creating something outside of root.
+		return nil, fmt.Errorf("%w: yet-to-be-created path %q contains '..' components", unix.ENOENT, remainingPath)
+	}
+
+	for _, part := range remainingParts {
+		switch part {
+		case "", ".":
+			// Skip no-op components.
+			continue
+		}
+
+		// Create the next component. EEXIST just means we lost the race to
+		// create it (possibly with another goroutine in this process), which
+		// is fine -- we re-open it below either way.
+		err := unix.Mkdirat(int(currentDir.Fd()), part, uint32(mode.Perm()))
+		err = os.NewSyscallError("mkdirat", err)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			_ = currentDir.Close()
+			return nil, fmt.Errorf("mkdirat %q: %w", part, err)
+		}
+
+		// Open an O_PATH handle to what we just created (or raced with).
+		// O_NOFOLLOW|O_DIRECTORY means that if an attacker has swapped the
+		// component for a symlink (or anything else) in between the mkdirat
+		// and this open, we simply fail rather than following it.
+		nextDir, err := openatFile(currentDir, part, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			_ = currentDir.Close()
+			return nil, fmt.Errorf("reopen newly-created directory %q: %w", part, err)
+		}
+		_ = currentDir.Close()
+		currentDir = nextDir
+	}
+	return currentDir, nil
+}
+
+// MkdirAll is a race-free equivalent of os.MkdirAll, where the new directory
+// is guaranteed to be within the root directory (if a component of the path
+// changes to a symlink after this function starts, an error will be returned
+// instead of MkdirAll blindly creating directories outside of root). root
+// must be an existing directory.
+//
+// Note that unsafePath is interpreted relative to root, and must not escape
+// root either lexically (../../foo) or through symlinks.
+func MkdirAll(root, unsafePath string, mode os.FileMode) error {
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer rootDir.Close()
+
+	f, err := MkdirAllHandle(rootDir, unsafePath, mode)
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return nil
+}
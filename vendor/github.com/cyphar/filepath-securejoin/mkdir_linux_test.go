@@ -0,0 +1,108 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMkdirAll_CreatesNestedDirs(t *testing.T) {
+	root := t.TempDir()
+
+	if err := MkdirAll(root, "a/b/c", 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(root, "a/b/c"))
+	if err != nil {
+		t.Fatalf("stat created directory: %v", err)
+	}
+	if !fi.IsDir() {
+		t.Errorf("created path is not a directory")
+	}
+}
+
+func TestMkdirAll_ExistingPrefixIsReused(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a/b"), 0o755); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	if err := MkdirAll(root, "a/b/c/d", 0o700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "a/b/c/d")); err != nil || !fi.IsDir() {
+		t.Fatalf("created path missing or not a directory: %v", err)
+	}
+}
+
+func TestMkdirAll_RefusesSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("setup symlink: %v", err)
+	}
+
+	// "escape" is a symlink pointing outside root, so the remaining
+	// component "pwned" must never be created inside outside, regardless of
+	// whether MkdirAll itself returns an error (since the symlink gets
+	// rebased to be relative to root, a nil error just means the resulting
+	// directory was created somewhere safely inside root instead).
+	_ = MkdirAll(root, "escape/pwned", 0o755)
+
+	if _, err := os.Stat(filepath.Join(outside, "pwned")); err == nil {
+		t.Fatalf("MkdirAll escaped root and created %q outside of it", filepath.Join(outside, "pwned"))
+	} else if !os.IsNotExist(err) {
+		t.Fatalf("stat %q: unexpected error: %v", filepath.Join(outside, "pwned"), err)
+	}
+}
+
+func TestMkdirAllHandle_RaceWithConcurrentCreator(t *testing.T) {
+	root := t.TempDir()
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("open root: %v", err)
+	}
+	defer rootDir.Close()
+
+	// Two goroutines racing to create (and lose to EEXIST on) the same
+	// tree should both succeed, each returning a handle, and leave the
+	// directory in place.
+	var wg sync.WaitGroup
+	results := make([]*os.File, 2)
+	errs := make([]error, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = MkdirAllHandle(rootDir, "race/dir", 0o755)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("MkdirAllHandle[%d]: %v", i, err)
+		}
+	}
+	for i, f := range results {
+		if f != nil {
+			f.Close()
+		} else if errs[i] == nil {
+			t.Errorf("MkdirAllHandle[%d] returned no handle and no error", i)
+		}
+	}
+
+	if fi, err := os.Stat(filepath.Join(root, "race/dir")); err != nil || !fi.IsDir() {
+		t.Fatalf("expected directory missing after race: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenatInRoot is equivalent to OpenInRoot, except that the root is provided
+// using an *os.File handle (to make it clear which root is being used). If
+// you only have a path, use OpenInRoot instead.
+//
+// The Path field of a returned ENOENT *os.PathError is resolved on a
+// best-effort basis via /proc, so it is a real path to rootDir even if
+// rootDir wasn't opened directly from a path string (for instance, a handle
+// obtained from Reopen or another in-root lookup). If that resolution fails,
+// rootDir.Name() is used instead.
+func OpenatInRoot(rootDir *os.File, unsafePath string) (*os.File, error) {
+	// We only care about the fully-resolved path, so on kernels that
+	// support it we first try a single openat2(RESOLVE_IN_ROOT) of the whole
+	// path -- the kernel does all of the escape-prevention for us. If that
+	// fails for any reason, we fall back to partialLookupInRoot, whose
+	// remaining path tells us whether to return ENOENT below.
+	if hasOpenat2() {
+		handle, err := openat2File(rootDir, unsafePath, &unix.OpenHow{
+			Flags:   unix.O_PATH | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_IN_ROOT,
+		})
+		if err == nil {
+			return handle, nil
+		}
+	}
+
+	handle, remainingPath, err := partialLookupInRoot(rootDir, unsafePath)
+	if err != nil {
+		return nil, err
+	}
+	if remainingPath != "" {
+		_ = handle.Close()
+		return nil, &os.PathError{
+			Op:   "openat",
+			Path: rootPath(rootDir) + "/" + unsafePath,
+			Err:  unix.ENOENT,
+		}
+	}
+	return handle, nil
+}
+
+// rootPath returns the best-effort real path of rootDir for use in error
+// messages. rootDir.Name() is only the actual root path when rootDir was
+// opened directly from a path string, as OpenInRoot does; a rootDir obtained
+// via Reopen, dup, or another in-root lookup may have a Name() that doesn't
+// reflect a real path at all, so we prefer resolving it through /proc and
+// only fall back to Name() if that fails.
+func rootPath(rootDir *os.File) string {
+	if real, err := procSelfFdReadlink(rootDir); err == nil {
+		return real
+	}
+	return rootDir.Name()
+}
+
+// OpenInRoot safely opens the provided unsafePath within the root directory,
+// without allowing any symlink (or ".." component) in unsafePath to escape
+// root -- effectively emulating what openat2(RESOLVE_IN_ROOT) would do. The
+// returned handle is opened with O_PATH, matching partialLookupInRoot; use
+// Reopen if you need a handle with different open flags.
+//
+// If any component of unsafePath (including the final component) does not
+// exist, a *os.PathError wrapping ENOENT is returned with Op set to
+// "openat", matching what callers would get from a bare openat2 call -- this
+// means callers don't need to interpret the "partial lookup" semantics of
+// partialLookupInRoot themselves.
+func OpenInRoot(root, unsafePath string) (*os.File, error) {
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rootDir.Close()
+
+	return OpenatInRoot(rootDir, unsafePath)
+}
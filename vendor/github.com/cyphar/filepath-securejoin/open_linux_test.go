@@ -0,0 +1,64 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenInRoot_OpensExistingFile(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), []byte("hello"), 0o644); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	handle, err := OpenInRoot(root, "file")
+	if err != nil {
+		t.Fatalf("OpenInRoot: %v", err)
+	}
+	defer handle.Close()
+}
+
+func TestOpenInRoot_MissingComponentIsENOENT(t *testing.T) {
+	root := t.TempDir()
+
+	_, err := OpenInRoot(root, "does/not/exist")
+	if err == nil {
+		t.Fatalf("OpenInRoot of a missing path unexpectedly succeeded")
+	}
+
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		t.Fatalf("OpenInRoot error = %v, want *os.PathError", err)
+	}
+	if pathErr.Op != "openat" {
+		t.Errorf("PathError.Op = %q, want %q", pathErr.Op, "openat")
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("OpenInRoot error = %v, want ENOENT", err)
+	}
+}
+
+func TestOpenatInRoot_RefusesSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("hi"), 0o644); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("setup symlink: %v", err)
+	}
+
+	handle, err := OpenInRoot(root, "escape/secret")
+	if err == nil {
+		_ = handle.Close()
+		t.Fatalf("OpenInRoot followed a symlink outside of root")
+	}
+}
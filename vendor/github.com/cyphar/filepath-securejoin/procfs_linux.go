@@ -0,0 +1,141 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// procThreadSelf returns a handle to <procfs>/thread-self/<subpath> (or
+// whatever the currently-configured ProcfsProvider considers equivalent, for
+// callers such as containers/storage that run inside a pid namespace where
+// the host's /proc/self is not usable). The handle is opened with O_PATH,
+// and the caller must call the returned closer once it's done with the
+// handle.
+func procThreadSelf(subpath string) (*os.File, func(), error) {
+	return getProcfsProvider().ThreadSelf(subpath)
+}
+
+// doProcSelfMagiclink opens the thread-self/fd directory as a known-safe
+// parent and applies op to the resulting (parent, single path component)
+// pair naming handle's magic-link. This is the "resolve one component under
+// a known-safe parent" pattern used by Reopen (which re-opens the
+// magic-link with new flags) in order to avoid an attacker using a
+// bind-mount over /proc to trick us into operating on the wrong file.
+func doProcSelfMagiclink[T any](handle *os.File, op func(dir *os.File, name string) (T, error)) (T, error) {
+	var zero T
+
+	fdDir, closer, err := procThreadSelf("fd")
+	if err != nil {
+		return zero, err
+	}
+	defer closer()
+
+	return op(fdDir, strconv.Itoa(int(handle.Fd())))
+}
+
+// procSelfFdReadlink returns the target of the /proc/thread-self/fd/$n
+// magic-link for the given handle -- this is effectively "what path does the
+// kernel think this fd corresponds to", and is used to double-check that a
+// lookup we've done actually ends up where we expect. This goes through the
+// configured ProcfsProvider's ReadlinkFd, rather than doProcSelfMagiclink,
+// since readlinking a fd is already part of that interface.
+func procSelfFdReadlink(handle *os.File) (string, error) {
+	return getProcfsProvider().ReadlinkFd(int(handle.Fd()))
+}
+
+// checkSymlinkOvermount verifies that the magic-link used to implement
+// Reopen (or any other /proc/thread-self/fd/$n-based operation) hasn't been
+// tampered with by an attacker bind-mounting something on top of /proc
+// itself. It does this by comparing the (dev, ino) of the handle we started
+// with against the (dev, ino) of whatever we ended up opening.
+func checkSymlinkOvermount(orig, reopened *os.File) error {
+	expected, err := fstat(orig)
+	if err != nil {
+		return fmt.Errorf("stat original handle: %w", err)
+	}
+	got, err := fstat(reopened)
+	if err != nil {
+		return fmt.Errorf("stat reopened handle: %w", err)
+	}
+	if expected.Dev != got.Dev || expected.Ino != got.Ino {
+		return fmt.Errorf("%w: reopened handle does not match original handle (possible /proc overmount attack)", errPossibleAttack)
+	}
+	return nil
+}
+
+// Reopen takes an *os.File handle (which may have been opened with O_PATH,
+// such as one returned by partialLookupInRoot or OpenInRoot) and returns a
+// new handle to the same file opened with the given flags, without ever
+// going through a path-based lookup that an attacker could race.
+//
+// This is implemented by opening /proc/thread-self/fd/$n for the provided
+// handle, which the kernel resolves atomically to the same underlying file
+// -- unlike a path-based re-open, which could be tricked into opening a
+// different file if the path was swapped out from under us. We still
+// double-check the result with fstat(2) to protect against an attacker who
+// has bind-mounted something on top of /proc itself, and we refuse to
+// reopen symlinks (since there is no safe flag combination for that).
+func Reopen(handle *os.File, flags int) (_ *os.File, Err error) {
+	// Make sure we aren't being asked to "reopen" a symlink -- there is no
+	// set of flags that makes that safe, and the only legitimate caller of
+	// Reopen is code that already has a non-symlink O_PATH handle.
+	if fi, err := handle.Stat(); err != nil {
+		return nil, fmt.Errorf("stat original handle: %w", err)
+	} else if fi.Mode()&os.ModeSymlink != 0 {
+		return nil, fmt.Errorf("%w: cannot reopen a symlink handle", errPossibleAttack)
+	}
+
+	flags |= unix.O_CLOEXEC
+	reopened, err := doProcSelfMagiclink(handle, func(procRoot *os.File, fdPath string) (*os.File, error) {
+		return openatFile(procRoot, fdPath, flags, 0)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reopen fd %d: %w", handle.Fd(), err)
+	}
+	defer func() {
+		if Err != nil {
+			_ = reopened.Close()
+		}
+	}()
+
+	if err := checkSymlinkOvermount(handle, reopened); err != nil {
+		return nil, fmt.Errorf("check reopened handle: %w", err)
+	}
+	return reopened, nil
+}
+
+// fstat is a thin wrapper around unix.Fstat that returns the raw
+// unix.Stat_t, used so that callers can compare (dev, ino) pairs directly.
+func fstat(f *os.File) (unix.Stat_t, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &stat); err != nil {
+		return stat, &os.PathError{Op: "fstat", Path: f.Name(), Err: err}
+	}
+	return stat, nil
+}
+
+// checkProcSelfFdPath verifies that file's magic-link target (as reported by
+// procSelfFdReadlink) is exactly path. This is used by partialLookupInRoot
+// after walking into a ".." component to make sure the root hasn't moved and
+// that the resulting path matches what we expect -- an attacker who renames
+// or remounts something mid-walk will cause this to fail rather than let us
+// silently operate on the wrong directory.
+func checkProcSelfFdPath(path string, file *os.File) error {
+	actual, err := procSelfFdReadlink(file)
+	if err != nil {
+		return err
+	}
+	if actual != path {
+		return fmt.Errorf("%w: expected %s to be %s but actually %s", errPossibleAttack, file.Name(), path, actual)
+	}
+	return nil
+}
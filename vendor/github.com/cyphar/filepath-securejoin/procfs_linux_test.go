@@ -0,0 +1,67 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReopen_UpgradesAccess(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	pathHandle, err := os.OpenFile(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("open O_PATH handle: %v", err)
+	}
+	defer pathHandle.Close()
+
+	rwHandle, err := Reopen(pathHandle, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	defer rwHandle.Close()
+
+	got, err := io.ReadAll(rwHandle)
+	if err != nil {
+		t.Fatalf("read reopened handle: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("reopened handle read %q, want %q", got, "hello")
+	}
+}
+
+func TestReopen_RefusesSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	if err := os.WriteFile(target, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("setup target: %v", err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("setup symlink: %v", err)
+	}
+
+	linkHandle, err := os.OpenFile(link, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("open O_PATH handle to symlink: %v", err)
+	}
+	defer linkHandle.Close()
+
+	if _, err := Reopen(linkHandle, os.O_RDONLY); !errors.Is(err, errPossibleAttack) {
+		t.Errorf("Reopen of a symlink handle = %v, want errPossibleAttack", err)
+	}
+}
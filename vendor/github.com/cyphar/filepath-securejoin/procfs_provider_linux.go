@@ -0,0 +1,198 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProcfsProvider abstracts how this package accesses procfs, so that callers
+// running in environments where the host's /proc is unavailable or
+// untrustworthy (a masked /proc, hidepid=, or operating on behalf of a
+// different pid namespace) can supply their own procfs handle rather than
+// us hard-coding access to the caller's /proc/self.
+type ProcfsProvider interface {
+	// ThreadSelf returns a handle to thread-self/<subpath> (or the nearest
+	// equivalent the provider can offer) opened with O_PATH, along with a
+	// closer that must be called once the caller is done with the handle.
+	ThreadSelf(subpath string) (*os.File, func(), error)
+	// ReadlinkFd returns the target of the magic-link for the given fd, as
+	// if by readlinkat(self/fd/<fd>).
+	ReadlinkFd(fd int) (string, error)
+}
+
+// defaultProcfsProvider implements ProcfsProvider using the calling
+// process's own /proc/thread-self (falling back to /proc/self on kernels
+// that predate it). This is the behaviour this package has always had, and
+// remains the default.
+type defaultProcfsProvider struct{}
+
+func (defaultProcfsProvider) ThreadSelf(subpath string) (*os.File, func(), error) {
+	// NOTE: /proc/thread-self is only correct if we are still on the same
+	// thread that opened the fd we are operating on. All of our callers are
+	// expected to not switch goroutines (and thus OS threads) in between
+	// opening the handle they want to operate on and calling this helper.
+	handle, err := os.OpenFile("/proc/thread-self/"+subpath, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		// Fall back to /proc/self, which will work as long as we haven't
+		// switched threads -- this should only matter on ancient kernels
+		// that predate /proc/thread-self (Linux < 3.17).
+		handle, err = os.OpenFile("/proc/self/"+subpath, unix.O_PATH|unix.O_CLOEXEC, 0)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("open /proc/thread-self/%s: %w", subpath, err)
+	}
+	return handle, func() { _ = handle.Close() }, nil
+}
+
+func (defaultProcfsProvider) ReadlinkFd(fd int) (string, error) {
+	self, closer, err := defaultProcfsProvider{}.ThreadSelf("")
+	if err != nil {
+		return "", err
+	}
+	defer closer()
+	return readlinkatFile(self, fmt.Sprintf("fd/%d", fd))
+}
+
+// privateProcfsProvider implements ProcfsProvider using a private procfs
+// instance, opened via fsopen(2)/fsmount(2). This is useful when the
+// caller's /proc may be masked, mounted with hidepid=, or otherwise
+// untrustworthy, but the caller still wants the convenience of not having to
+// supply their own procfs handle. See NewPrivateProcfsProvider, which caches
+// a single instance of this provider for the lifetime of the process.
+type privateProcfsProvider struct {
+	root *os.File
+}
+
+// newPrivateProcfsProvider creates a fresh procfs instance using
+// fsopen(2)+fsconfig(2)+fsmount(2), entirely independent of any bind-mount
+// tricks an attacker may have played on the caller's existing /proc.
+func newPrivateProcfsProvider() (*privateProcfsProvider, error) {
+	fsfd, err := unix.Fsopen("proc", unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("fsopen(proc): %w", err)
+	}
+	defer unix.Close(fsfd)
+
+	if err := unix.FsconfigCreate(fsfd); err != nil {
+		return nil, fmt.Errorf("fsconfig(FSCONFIG_CMD_CREATE): %w", err)
+	}
+
+	mfd, err := unix.Fsmount(fsfd, unix.FSMOUNT_CLOEXEC, unix.MOUNT_ATTR_NOEXEC|unix.MOUNT_ATTR_NOSUID|unix.MOUNT_ATTR_NODEV)
+	if err != nil {
+		return nil, fmt.Errorf("fsmount(proc): %w", err)
+	}
+	return &privateProcfsProvider{root: os.NewFile(uintptr(mfd), "privateProcRoot")}, nil
+}
+
+func (p *privateProcfsProvider) ThreadSelf(subpath string) (*os.File, func(), error) {
+	handle, err := openatFile(p.root, "thread-self/"+subpath, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open private procfs thread-self/%s: %w", subpath, err)
+	}
+	return handle, func() { _ = handle.Close() }, nil
+}
+
+func (p *privateProcfsProvider) ReadlinkFd(fd int) (string, error) {
+	self, closer, err := p.ThreadSelf("")
+	if err != nil {
+		return "", err
+	}
+	defer closer()
+	return readlinkatFile(self, fmt.Sprintf("fd/%d", fd))
+}
+
+// Close releases the private procfs mount. This is only needed by callers
+// that want to explicitly tear down a provider (for instance, tests); the
+// package-level singleton returned by NewPrivateProcfsProvider is kept open
+// for the lifetime of the process and does not need to be closed.
+func (p *privateProcfsProvider) Close() error {
+	return p.root.Close()
+}
+
+// callerProcfsProvider implements ProcfsProvider on top of a procfs root
+// handle supplied by the caller (for example, runc handing us a procfs
+// instance belonging to the container's pid namespace).
+type callerProcfsProvider struct {
+	root *os.File
+}
+
+// NewCallerProcfsProvider wraps an already-open procfs root (such as a
+// handle to a bind-mounted or namespaced /proc) as a ProcfsProvider. The
+// caller retains ownership of root and is responsible for closing it once
+// the provider is no longer in use.
+func NewCallerProcfsProvider(root *os.File) ProcfsProvider {
+	return &callerProcfsProvider{root: root}
+}
+
+func (p *callerProcfsProvider) ThreadSelf(subpath string) (*os.File, func(), error) {
+	handle, err := openatFile(p.root, "thread-self/"+subpath, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open caller-supplied procfs thread-self/%s: %w", subpath, err)
+	}
+	return handle, func() { _ = handle.Close() }, nil
+}
+
+func (p *callerProcfsProvider) ReadlinkFd(fd int) (string, error) {
+	self, closer, err := p.ThreadSelf("")
+	if err != nil {
+		return "", err
+	}
+	defer closer()
+	return readlinkatFile(self, fmt.Sprintf("fd/%d", fd))
+}
+
+var (
+	procfsProviderMu sync.Mutex
+	procfsProvider   ProcfsProvider = defaultProcfsProvider{}
+)
+
+// SetProcfsProvider overrides the ProcfsProvider used by partialLookupInRoot
+// and friends for the remainder of the process's lifetime. Callers such as
+// containers/storage that know their /proc may be masked or belong to the
+// wrong pid namespace should call this once at startup (with either a
+// private procfs instance created via NewPrivateProcfsProvider, or a
+// caller-supplied handle via NewCallerProcfsProvider) rather than paying the
+// cost of re-resolving procfs access on every lookup.
+func SetProcfsProvider(p ProcfsProvider) {
+	procfsProviderMu.Lock()
+	defer procfsProviderMu.Unlock()
+	procfsProvider = p
+}
+
+var (
+	privateProcfsOnce      sync.Once
+	privateProcfsSingleton *privateProcfsProvider
+	privateProcfsErr       error
+)
+
+// NewPrivateProcfsProvider returns a package-level singleton ProcfsProvider
+// backed by a private procfs instance, isolated from any tampering an
+// attacker may have done to the caller's existing /proc mount. The
+// underlying fsopen(2)+fsmount(2) mount is only created once (on the first
+// call) and is then reused and kept open for the remaining lifetime of the
+// process, so repeated calls (e.g. on a retry path in a long-lived daemon)
+// don't leak mount objects or file descriptors.
+func NewPrivateProcfsProvider() (ProcfsProvider, error) {
+	privateProcfsOnce.Do(func() {
+		privateProcfsSingleton, privateProcfsErr = newPrivateProcfsProvider()
+	})
+	if privateProcfsErr != nil {
+		return nil, privateProcfsErr
+	}
+	return privateProcfsSingleton, nil
+}
+
+func getProcfsProvider() ProcfsProvider {
+	procfsProviderMu.Lock()
+	defer procfsProviderMu.Unlock()
+	return procfsProvider
+}
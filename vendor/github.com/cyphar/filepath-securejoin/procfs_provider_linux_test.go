@@ -0,0 +1,111 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDefaultProcfsProvider_ThreadSelfAndReadlinkFd(t *testing.T) {
+	provider := defaultProcfsProvider{}
+
+	dir := t.TempDir()
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatalf("open tempdir: %v", err)
+	}
+	defer f.Close()
+
+	got, err := provider.ReadlinkFd(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("ReadlinkFd: %v", err)
+	}
+	if got != dir {
+		t.Errorf("ReadlinkFd = %q, want %q", got, dir)
+	}
+
+	handle, closer, err := provider.ThreadSelf("")
+	if err != nil {
+		t.Fatalf("ThreadSelf: %v", err)
+	}
+	defer closer()
+	if handle == nil {
+		t.Errorf("ThreadSelf returned a nil handle")
+	}
+}
+
+func TestNewPrivateProcfsProvider_IsCachedSingleton(t *testing.T) {
+	p1, err := NewPrivateProcfsProvider()
+	if err != nil {
+		t.Skipf("private procfs instance unavailable in this environment: %v", err)
+	}
+	p2, err := NewPrivateProcfsProvider()
+	if err != nil {
+		t.Fatalf("NewPrivateProcfsProvider (second call): %v", err)
+	}
+	if p1 != p2 {
+		t.Errorf("NewPrivateProcfsProvider returned different instances on repeated calls, want the same cached singleton")
+	}
+}
+
+func TestCallerProcfsProvider_ReadlinkFd(t *testing.T) {
+	procRoot, err := os.OpenFile("/proc", os.O_RDONLY, 0)
+	if err != nil {
+		t.Skipf("/proc unavailable: %v", err)
+	}
+	defer procRoot.Close()
+
+	provider := NewCallerProcfsProvider(procRoot)
+
+	dir := t.TempDir()
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatalf("open tempdir: %v", err)
+	}
+	defer f.Close()
+
+	got, err := provider.ReadlinkFd(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("ReadlinkFd: %v", err)
+	}
+	if got != dir {
+		t.Errorf("ReadlinkFd = %q, want %q", got, dir)
+	}
+}
+
+func TestSetProcfsProvider_IsUsedByProcThreadSelf(t *testing.T) {
+	orig := getProcfsProvider()
+	defer SetProcfsProvider(orig)
+
+	var called bool
+	SetProcfsProvider(recordingProcfsProvider{defaultProcfsProvider{}, &called})
+
+	handle, closer, err := procThreadSelf("")
+	if err != nil {
+		t.Fatalf("procThreadSelf: %v", err)
+	}
+	defer closer()
+	_ = handle
+
+	if !called {
+		t.Errorf("procThreadSelf did not use the overridden ProcfsProvider")
+	}
+}
+
+// recordingProcfsProvider wraps another ProcfsProvider and records whether
+// ThreadSelf was invoked, so tests can confirm SetProcfsProvider is actually
+// honored by procThreadSelf.
+type recordingProcfsProvider struct {
+	ProcfsProvider
+	called *bool
+}
+
+func (r recordingProcfsProvider) ThreadSelf(subpath string) (*os.File, func(), error) {
+	*r.called = true
+	return r.ProcfsProvider.ThreadSelf(subpath)
+}
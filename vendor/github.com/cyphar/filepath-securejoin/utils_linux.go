@@ -0,0 +1,53 @@
+//go:build linux
+
+// Copyright (C) 2024 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dupFile returns a new *os.File referring to the same underlying file
+// description as f (via F_DUPFD_CLOEXEC), so that callers can keep using f
+// while also handing out a separate, independently-closable handle.
+func dupFile(f *os.File) (*os.File, error) {
+	fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("fcntl(F_DUPFD_CLOEXEC)", err)
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// openatFile is a thin wrapper around openat(2) relative to dir, returning
+// an *os.File for the result. O_CLOEXEC is always added to flags.
+func openatFile(dir *os.File, path string, flags int, mode int) (*os.File, error) {
+	fd, err := unix.Openat(int(dir.Fd()), path, flags|unix.O_CLOEXEC, uint32(mode))
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), dir.Name()+"/"+path), nil
+}
+
+// readlinkatFile is a thin wrapper around readlinkat(2) relative to dir,
+// growing its buffer until the whole link target fits.
+func readlinkatFile(dir *os.File, path string) (string, error) {
+	size := 128
+	for {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(int(dir.Fd()), path, buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlinkat", Path: path, Err: err}
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+		// The buffer may have been too small to fit the whole link target;
+		// try again with more space.
+		size *= 2
+	}
+}